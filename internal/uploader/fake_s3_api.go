@@ -0,0 +1,113 @@
+package uploader
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	stds3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+func awsNotFoundErr() error {
+	return awserr.NewRequestFailure(awserr.New("NotFound", "bucket not found", nil), 404, "req-id")
+}
+
+func awsForbiddenErr() error {
+	return awserr.NewRequestFailure(awserr.New("Forbidden", "credentials rejected", nil), 403, "req-id")
+}
+
+// fakeS3API is a minimal, in-memory stand-in for S3API used to exercise
+// Uploader without a real S3 endpoint.
+type fakeS3API struct {
+	headBucketErr   error
+	bucketNotFound  bool
+	createBucketErr error
+
+	createMultipartUploadErr error
+	uploadID                 string
+
+	inProgressUploads       []*stds3.MultipartUpload
+	listMultipartUploadsErr error
+
+	existingParts []*stds3.Part
+	listPartsErr  error
+
+	uploadPartErr    error
+	failUploadPartsN int // fail the first N UploadPart calls (at least one if uploadPartErr is set), then succeed
+
+	completeErr error
+
+	// mu guards uploadPartCalls, which multipartUpload's concurrent
+	// per-part goroutines all increment.
+	mu              sync.Mutex
+	uploadPartCalls int
+}
+
+func (f *fakeS3API) HeadBucket(*stds3.HeadBucketInput) (*stds3.HeadBucketOutput, error) {
+	if f.headBucketErr != nil {
+		return nil, f.headBucketErr
+	}
+	if f.bucketNotFound {
+		return nil, awsNotFoundErr()
+	}
+	return &stds3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3API) CreateBucket(*stds3.CreateBucketInput) (*stds3.CreateBucketOutput, error) {
+	if f.createBucketErr != nil {
+		return nil, f.createBucketErr
+	}
+	return &stds3.CreateBucketOutput{}, nil
+}
+
+func (f *fakeS3API) CreateMultipartUpload(*stds3.CreateMultipartUploadInput) (*stds3.CreateMultipartUploadOutput, error) {
+	if f.createMultipartUploadErr != nil {
+		return nil, f.createMultipartUploadErr
+	}
+	uploadID := f.uploadID
+	if uploadID == "" {
+		uploadID = "fake-upload-id"
+	}
+	return &stds3.CreateMultipartUploadOutput{UploadId: &uploadID}, nil
+}
+
+func (f *fakeS3API) ListMultipartUploads(*stds3.ListMultipartUploadsInput) (*stds3.ListMultipartUploadsOutput, error) {
+	if f.listMultipartUploadsErr != nil {
+		return nil, f.listMultipartUploadsErr
+	}
+	return &stds3.ListMultipartUploadsOutput{Uploads: f.inProgressUploads}, nil
+}
+
+func (f *fakeS3API) ListParts(*stds3.ListPartsInput) (*stds3.ListPartsOutput, error) {
+	if f.listPartsErr != nil {
+		return nil, f.listPartsErr
+	}
+	return &stds3.ListPartsOutput{Parts: f.existingParts}, nil
+}
+
+func (f *fakeS3API) UploadPart(*stds3.UploadPartInput) (*stds3.UploadPartOutput, error) {
+	f.mu.Lock()
+	f.uploadPartCalls++
+	calls := f.uploadPartCalls
+	f.mu.Unlock()
+
+	if f.uploadPartErr != nil && calls <= max(f.failUploadPartsN, 1) {
+		return nil, f.uploadPartErr
+	}
+	etag := "etag"
+	return &stds3.UploadPartOutput{ETag: &etag}, nil
+}
+
+// UploadPartCalls returns the number of times UploadPart has been called,
+// safe to read from a test while concurrent uploads may still be running.
+func (f *fakeS3API) UploadPartCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.uploadPartCalls
+}
+
+func (f *fakeS3API) CompleteMultipartUpload(*stds3.CompleteMultipartUploadInput) (*stds3.CompleteMultipartUploadOutput, error) {
+	if f.completeErr != nil {
+		return nil, f.completeErr
+	}
+	return &stds3.CompleteMultipartUploadOutput{}, nil
+}
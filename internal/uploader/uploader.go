@@ -0,0 +1,591 @@
+// Package uploader contains the S3 upload orchestration used by the sdk
+// upload method: bucket existence checks and a resumable, checkpointed
+// multipart upload. It depends only on the narrow S3API interface so it
+// can be driven by a fake in tests instead of a real S3 endpoint.
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	stds3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	// DefaultPartSize is the multipart upload part size used when Params
+	// doesn't specify one, set to the S3 minimum.
+	DefaultPartSize = 5 * 1024 * 1024
+	// DefaultConcurrency is the number of parts uploaded at a time when
+	// Params doesn't specify one.
+	DefaultConcurrency = 4
+)
+
+// S3API is the subset of *s3.S3 the uploader depends on. It exists so
+// tests can supply a fake instead of talking to a real S3 endpoint.
+type S3API interface {
+	HeadBucket(*stds3.HeadBucketInput) (*stds3.HeadBucketOutput, error)
+	CreateBucket(*stds3.CreateBucketInput) (*stds3.CreateBucketOutput, error)
+	CreateMultipartUpload(*stds3.CreateMultipartUploadInput) (*stds3.CreateMultipartUploadOutput, error)
+	ListMultipartUploads(*stds3.ListMultipartUploadsInput) (*stds3.ListMultipartUploadsOutput, error)
+	ListParts(*stds3.ListPartsInput) (*stds3.ListPartsOutput, error)
+	UploadPart(*stds3.UploadPartInput) (*stds3.UploadPartOutput, error)
+	CompleteMultipartUpload(*stds3.CompleteMultipartUploadInput) (*stds3.CompleteMultipartUploadOutput, error)
+}
+
+// Uploader uploads a local file to S3. This takes a plain Params struct and
+// a synchronous Upload(Params) error rather than the originally-discussed
+// UploadWithContext(ctx, *s3manager.UploadInput, ...)/fakeUploader shape:
+// once resumable uploads ruled out s3manager (see multipartUpload), there
+// was no s3manager.UploadInput left to take context/options from, so the
+// narrower S3API interface above, faked by fakeS3API in tests, replaced it.
+type Uploader interface {
+	Upload(Params) error
+}
+
+// Params describes a single upload.
+type Params struct {
+	SourcePath  string
+	Bucket      string
+	Key         string
+	PartSize    int64
+	Concurrency int
+	Checkpoint  string
+	Resume      bool
+
+	// ACL is the canned ACL applied to the object, e.g. "private" or
+	// "public-read". Defaults to "private" when empty.
+	ACL string
+	// ServerSideEncryption is "AES256" or "aws:kms", or empty to disable SSE.
+	ServerSideEncryption string
+	// SSEKMSKeyID is the KMS key ID/ARN to use when ServerSideEncryption is
+	// "aws:kms". Ignored otherwise.
+	SSEKMSKeyID string
+	// StorageClass is the S3 storage class, e.g. "STANDARD_IA". Defaults to
+	// the bucket default when empty.
+	StorageClass string
+	// ContentType is the object's Content-Type. When empty, it is detected
+	// from Key's extension, falling back to "application/octet-stream".
+	ContentType string
+	// Metadata is stored as user-defined object metadata.
+	Metadata map[string]string
+	// Tagging is a URL-encoded tag set, e.g. "project=foo&env=prod".
+	Tagging string
+}
+
+type uploader struct {
+	api    S3API
+	logger lager.Logger
+}
+
+// New returns an Uploader that drives uploads against api.
+func New(api S3API, logger lager.Logger) Uploader {
+	return &uploader{api: api, logger: logger}
+}
+
+func (u *uploader) Upload(p Params) error {
+	u.logger.Info("find-bucket", lager.Data{"event": "starting"})
+
+	found, err := u.bucketExists(p.Bucket)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		u.logger.Info("find-bucket", lager.Data{"event": "found"})
+	} else {
+		u.logger.Info("find-bucket", lager.Data{"event": "not-found"})
+
+		u.logger.Info("create-bucket", lager.Data{"event": "starting"})
+		if err := u.createBucket(p.Bucket); err != nil {
+			return err
+		}
+		u.logger.Info("create-bucket", lager.Data{"event": "done"})
+	}
+
+	u.logger.Info("find-bucket", lager.Data{"event": "done"})
+
+	file, err := os.Open(p.SourcePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	u.logger.Info("upload", lager.Data{"event": "starting"})
+
+	if err := u.multipartUpload(p, file); err != nil {
+		return err
+	}
+
+	u.logger.Info("upload", lager.Data{"event": "done"})
+
+	return nil
+}
+
+func (u *uploader) bucketExists(bucketName string) (bool, error) {
+	params := &stds3.HeadBucketInput{
+		Bucket: aws.String(bucketName), // Required
+	}
+
+	_, err := u.api.HeadBucket(params)
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			if reqErr.StatusCode() == 404 {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (u *uploader) createBucket(bucketName string) error {
+	params := &stds3.CreateBucketInput{
+		Bucket: aws.String(bucketName),
+		ACL:    aws.String("private"),
+		CreateBucketConfiguration: &stds3.CreateBucketConfiguration{
+			LocationConstraint: nil,
+		},
+		GrantFullControl: aws.String("GrantFullControl"),
+		GrantRead:        aws.String("GrantRead"),
+		GrantReadACP:     aws.String("GrantReadACP"),
+		GrantWrite:       aws.String("GrantWrite"),
+		GrantWriteACP:    aws.String("GrantWriteACP"),
+	}
+
+	_, err := u.api.CreateBucket(params)
+
+	return err
+}
+
+// checkpointState is persisted to Params.Checkpoint so an interrupted
+// upload can be resumed without re-uploading parts that already landed in
+// S3.
+type checkpointState struct {
+	Bucket    string          `json:"bucket"`
+	Key       string          `json:"key"`
+	UploadID  string          `json:"upload_id"`
+	PartSize  int64           `json:"part_size"`
+	Completed []completedPart `json:"completed_parts"`
+}
+
+type completedPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size,omitempty"`
+}
+
+// multipartUpload drives a resumable multipart upload of file to
+// p.Bucket/p.Key. When p.Resume is set and a matching checkpoint exists, it
+// reconciles already-uploaded parts against S3 via ListParts and only
+// uploads the remaining ranges.
+//
+// This hand-rolls the CreateMultipartUpload/UploadPart/CompleteMultipartUpload
+// calls rather than using s3manager.Uploader: s3manager has no concept of
+// resuming a prior upload ID, so LeavePartsOnError alone wouldn't get us
+// restart-without-re-uploading, which is the point of -resume. There's no
+// equivalent on the -method=cli path, by design — see cliUpload's -resume
+// rejection.
+func (u *uploader) multipartUpload(p Params, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	partSize := p.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+
+	concurrency := p.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	state, err := u.loadOrCreateCheckpoint(p, partSize)
+	if err != nil {
+		return err
+	}
+
+	// The checkpoint is authoritative on resume: every already-uploaded
+	// part's offset/length was computed from it, so re-deriving them from
+	// a different -part-size would misalign the remaining ranges and
+	// produce a corrupt object on CompleteMultipartUpload.
+	if p.PartSize > 0 && p.PartSize != state.PartSize {
+		return fmt.Errorf("checkpoint %s was created with part size %d, but %d was requested; resume with -part-size=%d or start a new upload", p.Checkpoint, state.PartSize, p.PartSize, state.PartSize)
+	}
+	partSize = state.PartSize
+
+	completed := map[int64]string{}
+	for _, part := range state.Completed {
+		completed[part.PartNumber] = part.ETag
+	}
+
+	totalParts := (info.Size() + partSize - 1) / partSize
+	if totalParts == 0 {
+		totalParts = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, concurrency)
+	)
+
+	for partNumber := int64(1); partNumber <= totalParts; partNumber++ {
+		if _, ok := completed[partNumber]; ok {
+			u.logger.Info("upload-part", lager.Data{"event": "skipped", "part": partNumber})
+			continue
+		}
+
+		offset := (partNumber - 1) * partSize
+		length := partSize
+		if offset+length > info.Size() {
+			length = info.Size() - offset
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(partNumber, offset, length int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			etag, err := u.uploadPart(p.Bucket, p.Key, state.UploadID, file, partNumber, offset, length)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+
+			state.Completed = append(state.Completed, completedPart{PartNumber: partNumber, ETag: etag})
+			u.logger.Info("upload-part", lager.Data{"event": "done", "part": partNumber})
+
+			if p.Checkpoint != "" {
+				if err := saveCheckpoint(p.Checkpoint, state); err != nil {
+					u.logger.Error("save-checkpoint", err)
+				}
+			}
+		}(partNumber, offset, length)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := u.completeMultipartUpload(p.Bucket, p.Key, state.UploadID, state.Completed); err != nil {
+		return err
+	}
+
+	if p.Checkpoint != "" {
+		os.Remove(p.Checkpoint)
+	}
+
+	return nil
+}
+
+// loadOrCreateCheckpoint resumes an in-progress multipart upload for
+// p.Bucket/p.Key when p.Resume is set, or starts a new one otherwise. If the
+// checkpoint file is missing or stale, it falls back to discovering an
+// in-progress upload directly from S3 via ListMultipartUploads, so a lost
+// checkpoint doesn't strand an otherwise-resumable upload.
+func (u *uploader) loadOrCreateCheckpoint(p Params, partSize int64) (*checkpointState, error) {
+	if p.Resume {
+		if p.Checkpoint != "" {
+			if state, err := readCheckpoint(p.Checkpoint); err == nil && state.Bucket == p.Bucket && state.Key == p.Key {
+				parts, err := u.listCompletedParts(p.Bucket, p.Key, state.UploadID)
+				if err == nil {
+					u.logger.Info("resume-upload", lager.Data{"event": "found", "upload-id": state.UploadID, "parts": len(parts)})
+					state.Completed = parts
+					return state, nil
+				}
+				u.logger.Info("resume-upload", lager.Data{"event": "stale-checkpoint", "error": err.Error()})
+			}
+		}
+
+		if state, err := u.recoverFromInProgressUpload(p, partSize); err != nil {
+			u.logger.Info("resume-upload", lager.Data{"event": "list-multipart-uploads-failed", "error": err.Error()})
+		} else if state != nil {
+			return state, nil
+		}
+	}
+
+	uploadID, err := u.createMultipartUpload(p)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &checkpointState{
+		Bucket:   p.Bucket,
+		Key:      p.Key,
+		UploadID: uploadID,
+		PartSize: partSize,
+	}
+
+	if p.Checkpoint != "" {
+		if err := saveCheckpoint(p.Checkpoint, state); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// recoverFromInProgressUpload looks for an in-progress multipart upload for
+// p.Bucket/p.Key via ListMultipartUploads and, if one exists, reconstructs a
+// checkpoint for it via ListParts. The part size can't be read back from S3,
+// so it's inferred from an already-uploaded part's size; defaultPartSize is
+// used only if no parts have completed yet.
+func (u *uploader) recoverFromInProgressUpload(p Params, defaultPartSize int64) (*checkpointState, error) {
+	uploadID, err := u.findInProgressUpload(p.Bucket, p.Key)
+	if err != nil {
+		return nil, err
+	}
+	if uploadID == "" {
+		return nil, nil
+	}
+
+	parts, err := u.listCompletedParts(p.Bucket, p.Key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := defaultPartSize
+	if len(parts) > 0 {
+		partSize = parts[0].Size
+	}
+
+	u.logger.Info("resume-upload", lager.Data{"event": "found-via-list-multipart-uploads", "upload-id": uploadID, "parts": len(parts)})
+
+	state := &checkpointState{
+		Bucket:    p.Bucket,
+		Key:       p.Key,
+		UploadID:  uploadID,
+		PartSize:  partSize,
+		Completed: parts,
+	}
+
+	if p.Checkpoint != "" {
+		if err := saveCheckpoint(p.Checkpoint, state); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// findInProgressUpload returns the upload ID of an in-progress multipart
+// upload for bucket/key, or "" if none is in progress.
+func (u *uploader) findInProgressUpload(bucket, key string) (string, error) {
+	resp, err := u.api.ListMultipartUploads(&stds3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, upload := range resp.Uploads {
+		if aws.StringValue(upload.Key) == key {
+			return aws.StringValue(upload.UploadId), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (u *uploader) createMultipartUpload(p Params) (string, error) {
+	acl := p.ACL
+	if acl == "" {
+		acl = "private"
+	}
+
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(p.Key))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	input := &stds3.CreateMultipartUploadInput{
+		ACL:         aws.String(acl),
+		Bucket:      aws.String(p.Bucket),
+		Key:         aws.String(p.Key),
+		ContentType: aws.String(contentType),
+	}
+
+	if p.StorageClass != "" {
+		input.StorageClass = aws.String(p.StorageClass)
+	}
+
+	if p.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(p.ServerSideEncryption)
+		if p.ServerSideEncryption == "aws:kms" && p.SSEKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(p.SSEKMSKeyID)
+		}
+	}
+
+	if p.Tagging != "" {
+		input.Tagging = aws.String(p.Tagging)
+	}
+
+	if len(p.Metadata) > 0 {
+		metadata := make(map[string]*string, len(p.Metadata))
+		for k, v := range p.Metadata {
+			metadata[k] = aws.String(v)
+		}
+		input.Metadata = metadata
+	}
+
+	resp, err := u.api.CreateMultipartUpload(input)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(resp.UploadId), nil
+}
+
+func (u *uploader) listCompletedParts(bucket, key, uploadID string) ([]completedPart, error) {
+	var parts []completedPart
+
+	input := &stds3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+
+	for {
+		resp, err := u.api.ListParts(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, part := range resp.Parts {
+			parts = append(parts, completedPart{
+				PartNumber: aws.Int64Value(part.PartNumber),
+				ETag:       aws.StringValue(part.ETag),
+				Size:       aws.Int64Value(part.Size),
+			})
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+
+		input.PartNumberMarker = resp.NextPartNumberMarker
+	}
+
+	return parts, nil
+}
+
+// maxUploadPartAttempts bounds how many times a single part is attempted,
+// counting the first try, before a retryable failure makes the upload give
+// up; a part is thus retried at most maxUploadPartAttempts-1 times.
+const maxUploadPartAttempts = 3
+
+func (u *uploader) uploadPart(bucket, key, uploadID string, file *os.File, partNumber, offset, length int64) (string, error) {
+	buf := make([]byte, length)
+	if _, err := file.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	var err error
+
+	for attempt := 1; attempt <= maxUploadPartAttempts; attempt++ {
+		var resp *stds3.UploadPartOutput
+		resp, err = u.api.UploadPart(&stds3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			UploadId:   aws.String(uploadID),
+			PartNumber: aws.Int64(partNumber),
+			Body:       bytes.NewReader(buf),
+		})
+		if err == nil {
+			return aws.StringValue(resp.ETag), nil
+		}
+
+		if !isRetryable(err) || attempt == maxUploadPartAttempts {
+			break
+		}
+
+		u.logger.Info("upload-part", lager.Data{"event": "retrying", "part": partNumber, "attempt": attempt, "error": err.Error()})
+	}
+
+	return "", err
+}
+
+// isRetryable reports whether err is worth retrying: a 5xx response or
+// anything that isn't an AWS request failure at all (e.g. a transport-level
+// connection error). 4xx responses (bad credentials, bad request) are not
+// retried since retrying them can't succeed.
+func isRetryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+	return true
+}
+
+func (u *uploader) completeMultipartUpload(bucket, key, uploadID string, parts []completedPart) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+
+	completedParts := make([]*stds3.CompletedPart, len(parts))
+	for i, part := range parts {
+		completedParts[i] = &stds3.CompletedPart{
+			PartNumber: aws.Int64(part.PartNumber),
+			ETag:       aws.String(part.ETag),
+		}
+	}
+
+	_, err := u.api.CompleteMultipartUpload(&stds3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+		MultipartUpload: &stds3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+
+	return err
+}
+
+func readCheckpoint(path string) (*checkpointState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &checkpointState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func saveCheckpoint(path string, state *checkpointState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,158 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	stds3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+func writeTempFile(t *testing.T, size int) string {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "uploader-test")
+	if err != nil {
+		t.Fatalf("CreateTemp: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(make([]byte, size)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	return f.Name()
+}
+
+func TestUpload(t *testing.T) {
+	cases := []struct {
+		name    string
+		api     *fakeS3API
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  &fakeS3API{},
+		},
+		{
+			name: "bucket missing is not an error",
+			api:  &fakeS3API{bucketNotFound: true},
+		},
+		{
+			name:    "credential error on find-bucket",
+			api:     &fakeS3API{headBucketErr: awsForbiddenErr()},
+			wantErr: true,
+		},
+		{
+			name: "transient upload-part failure recovers after retry",
+			api:  &fakeS3API{uploadPartErr: errors.New("connection reset"), failUploadPartsN: 1},
+		},
+		{
+			name:    "upload-part failure surfaces once retries are exhausted",
+			api:     &fakeS3API{uploadPartErr: errors.New("connection reset"), failUploadPartsN: 5},
+			wantErr: true,
+		},
+		{
+			name:    "non-retryable upload-part failure surfaces immediately",
+			api:     &fakeS3API{uploadPartErr: awsForbiddenErr(), failUploadPartsN: 1},
+			wantErr: true,
+		},
+		{
+			name:    "complete-multipart-upload failure surfaces",
+			api:     &fakeS3API{completeErr: errors.New("entity too small")},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := lagertest.NewTestLogger("uploader-test")
+			u := New(c.api, logger)
+
+			err := u.Upload(Params{
+				SourcePath: writeTempFile(t, 1024),
+				Bucket:     "a-bucket",
+				Key:        "a-key",
+			})
+
+			if c.wantErr && err == nil {
+				t.Fatalf("expected an error, got none")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestUploadRetriesTransientUploadPartFailuresOnly(t *testing.T) {
+	logger := lagertest.NewTestLogger("uploader-test")
+
+	api := &fakeS3API{uploadPartErr: errors.New("connection reset"), failUploadPartsN: 1}
+	if err := New(api, logger).Upload(Params{
+		SourcePath: writeTempFile(t, 1024),
+		Bucket:     "a-bucket",
+		Key:        "a-key",
+	}); err != nil {
+		t.Fatalf("Upload: %s", err)
+	}
+	if api.UploadPartCalls() != 2 {
+		t.Fatalf("expected the transient failure to be retried once, got %d UploadPart calls", api.UploadPartCalls())
+	}
+
+	api = &fakeS3API{uploadPartErr: awsForbiddenErr(), failUploadPartsN: 1}
+	if err := New(api, logger).Upload(Params{
+		SourcePath: writeTempFile(t, 1024),
+		Bucket:     "a-bucket",
+		Key:        "a-key",
+	}); err == nil {
+		t.Fatalf("expected a non-retryable error, got none")
+	}
+	if api.UploadPartCalls() != 1 {
+		t.Fatalf("expected a non-retryable failure not to be retried, got %d UploadPart calls", api.UploadPartCalls())
+	}
+}
+
+func TestUploadResumeSkipsCompletedParts(t *testing.T) {
+	logger := lagertest.NewTestLogger("uploader-test")
+	checkpointPath := writeTempFile(t, 0)
+
+	etag := "existing-etag"
+	partNumber := int64(1)
+	api := &fakeS3API{
+		uploadID: "resumed-upload-id",
+		existingParts: []*stds3.Part{
+			{PartNumber: &partNumber, ETag: &etag},
+		},
+	}
+
+	if err := saveCheckpoint(checkpointPath, &checkpointState{
+		Bucket:   "a-bucket",
+		Key:      "a-key",
+		UploadID: "resumed-upload-id",
+		PartSize: DefaultPartSize,
+	}); err != nil {
+		t.Fatalf("saveCheckpoint: %s", err)
+	}
+
+	u := New(api, logger)
+
+	err := u.Upload(Params{
+		SourcePath: writeTempFile(t, DefaultPartSize+1),
+		Bucket:     "a-bucket",
+		Key:        "a-key",
+		PartSize:   DefaultPartSize,
+		Checkpoint: checkpointPath,
+		Resume:     true,
+	})
+	if err != nil {
+		t.Fatalf("Upload: %s", err)
+	}
+
+	if api.UploadPartCalls() != 1 {
+		t.Fatalf("expected the already-completed part to be skipped, got %d UploadPart calls", api.UploadPartCalls())
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	stds3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-golang/lager"
+	"github.com/st3v/s3upload/internal/uploader"
+)
+
+// sha256MetadataKey is the object metadata key sync stamps on every object
+// it uploads, recording the local file's content hash so a later run can
+// detect unchanged files via HeadObject instead of re-uploading them.
+const sha256MetadataKey = "sha256"
+
+func syncMain(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	common := bindCommonFlags(fs)
+
+	sourceDir := fs.String("source", "", "Source directory to sync, recursively.")
+	bucketName := fs.String("bucket", "", "Bucket name.")
+	targetPrefix := fs.String("target-prefix", "", "Key prefix objects are uploaded under.")
+	partSize := fs.Int64("part-size", uploader.DefaultPartSize, "Multipart upload part size, in bytes, per file.")
+	concurrency := fs.Int("concurrency", uploader.DefaultConcurrency, "Number of parts to upload concurrently, per file.")
+	parallel := fs.Int("parallel", uploader.DefaultConcurrency, "Number of files to sync concurrently.")
+	deleteExtra := fs.Bool("delete", false, "Delete remote objects under -target-prefix that no longer exist locally.")
+	exclude := fs.String("exclude", "", "Glob pattern, matched against each file's base name at any depth under -source (e.g. '*.log'), of files to skip.")
+	include := fs.String("include", "", "Glob pattern, matched against each file's base name at any depth under -source, of files to sync; all others are skipped. Applied after -exclude.")
+	dryRun := fs.Bool("dry-run", false, "Log what would be uploaded/deleted without changing anything in S3.")
+
+	fs.Parse(args)
+
+	if *sourceDir == "" || *bucketName == "" || *common.endpoint == "" || *common.region == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *parallel <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	logger := lager.NewLogger("s3-sync")
+	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
+
+	creds := buildCredentialChain(common.credentialChainOptions(), logger)
+
+	if _, err := creds.Get(); err != nil {
+		logError("credentials", fmt.Errorf("no credential provider in the chain could supply AWS credentials: %s", err), logger)
+	}
+
+	svc, err := newS3Client(*common.endpoint, *common.region, creds, common.isS3Compatible(), *common.insecure)
+	if err != nil {
+		logError("sync", err, logger)
+	}
+
+	s := &syncer{
+		svc:          svc,
+		up:           uploader.New(svc, logger),
+		logger:       logger,
+		bucket:       *bucketName,
+		targetPrefix: strings.Trim(*targetPrefix, "/"),
+		partSize:     *partSize,
+		concurrency:  *concurrency,
+		dryRun:       *dryRun,
+	}
+
+	if err := s.run(*sourceDir, *exclude, *include, *deleteExtra, *parallel); err != nil {
+		logError("sync", err, logger)
+	}
+}
+
+// syncer walks a local directory tree and reconciles it against a bucket
+// prefix: unchanged files are skipped, new or modified files are uploaded
+// via uploader.Uploader, and, if requested, remote objects with no local
+// counterpart are removed.
+type syncer struct {
+	svc *stds3.S3
+	up  uploader.Uploader
+
+	logger lager.Logger
+
+	bucket       string
+	targetPrefix string
+	partSize     int64
+	concurrency  int
+	dryRun       bool
+}
+
+type syncStatus int
+
+const (
+	syncUploaded syncStatus = iota
+	syncSkipped
+)
+
+type syncResult struct {
+	uploaded int
+	skipped  int
+	deleted  int
+	failed   int
+}
+
+func (s *syncer) run(sourceDir, excludePattern, includePattern string, deleteExtra bool, parallel int) error {
+	files, err := walkSource(sourceDir, excludePattern, includePattern)
+	if err != nil {
+		return err
+	}
+
+	result := &syncResult{}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallel)
+	)
+
+	for _, rel := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(rel string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			status, err := s.syncFile(sourceDir, rel)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				result.failed++
+				s.logger.Error("sync-file", err, lager.Data{"path": rel})
+				return
+			}
+
+			if status == syncUploaded {
+				result.uploaded++
+			} else {
+				result.skipped++
+			}
+		}(rel)
+	}
+
+	wg.Wait()
+
+	if deleteExtra {
+		deleted, err := s.deleteExtraneous(files)
+		if err != nil {
+			result.failed++
+			s.logger.Error("delete-extraneous", err)
+		}
+		result.deleted = deleted
+	}
+
+	s.logger.Info("sync", lager.Data{
+		"uploaded": result.uploaded,
+		"skipped":  result.skipped,
+		"deleted":  result.deleted,
+		"failed":   result.failed,
+	})
+
+	if result.failed > 0 {
+		return fmt.Errorf("sync completed with %d failure(s)", result.failed)
+	}
+
+	return nil
+}
+
+// walkSource recursively collects sourceDir's files, relative to sourceDir
+// with forward slashes, filtered by excludePattern/includePattern.
+func walkSource(sourceDir, excludePattern, includePattern string) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(sourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		base := filepath.Base(rel)
+
+		// filepath.Match's "*" doesn't cross "/", so matching it against
+		// the full relative path would only ever match top-level entries
+		// in a recursive sync. Match against the basename instead, so e.g.
+		// -exclude='*.log' skips *.log files at any depth.
+		if excludePattern != "" {
+			if ok, _ := filepath.Match(excludePattern, base); ok {
+				return nil
+			}
+		}
+
+		if includePattern != "" {
+			if ok, _ := filepath.Match(includePattern, base); !ok {
+				return nil
+			}
+		}
+
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// syncFile uploads the single file at sourceDir/rel if it's new or its
+// content differs from what's already at its key, or reports it as skipped
+// otherwise.
+func (s *syncer) syncFile(sourceDir, rel string) (syncStatus, error) {
+	localPath := filepath.Join(sourceDir, filepath.FromSlash(rel))
+	key := s.key(rel)
+
+	sha256Hex, md5Hex, err := fileHashes(localPath)
+	if err != nil {
+		return 0, err
+	}
+
+	unchanged, err := s.unchanged(key, sha256Hex, md5Hex)
+	if err != nil {
+		s.logger.Info("head-object", lager.Data{"event": "error", "key": key, "error": err.Error()})
+	} else if unchanged {
+		s.logger.Info("sync-file", lager.Data{"event": "skipped", "key": key})
+		return syncSkipped, nil
+	}
+
+	if s.dryRun {
+		s.logger.Info("sync-file", lager.Data{"event": "would-upload", "key": key})
+		return syncUploaded, nil
+	}
+
+	s.logger.Info("sync-file", lager.Data{"event": "uploading", "key": key})
+
+	err = s.up.Upload(uploader.Params{
+		SourcePath:  localPath,
+		Bucket:      s.bucket,
+		Key:         key,
+		PartSize:    s.partSize,
+		Concurrency: s.concurrency,
+		Metadata:    map[string]string{sha256MetadataKey: sha256Hex},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return syncUploaded, nil
+}
+
+func (s *syncer) key(rel string) string {
+	if s.targetPrefix == "" {
+		return rel
+	}
+	return s.targetPrefix + "/" + rel
+}
+
+// unchanged reports whether the object at key already holds this content,
+// preferring the sha256 metadata this tool stamps on its own uploads and
+// falling back to comparing md5Hex against the ETag for objects that don't
+// have it (e.g. uploaded by some other tool, or as a single part).
+func (s *syncer) unchanged(key, sha256Hex, md5Hex string) (bool, error) {
+	resp, err := s.svc.HeadObject(&stds3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if existing, ok := metadataValue(resp.Metadata, sha256MetadataKey); ok {
+		return existing == sha256Hex, nil
+	}
+
+	return strings.Trim(aws.StringValue(resp.ETag), `"`) == md5Hex, nil
+}
+
+// metadataValue looks up key in metadata, accounting for S3 normalizing
+// metadata keys to canonical HTTP header form when it returns them.
+func metadataValue(metadata map[string]*string, key string) (string, bool) {
+	if v, ok := metadata[key]; ok {
+		return aws.StringValue(v), true
+	}
+	if v, ok := metadata[http.CanonicalHeaderKey(key)]; ok {
+		return aws.StringValue(v), true
+	}
+	return "", false
+}
+
+// deleteExtraneous removes objects under s.targetPrefix that have no
+// corresponding entry in localFiles, returning the number removed (or that
+// would be removed, under -dry-run).
+func (s *syncer) deleteExtraneous(localFiles []string) (int, error) {
+	local := make(map[string]bool, len(localFiles))
+	for _, rel := range localFiles {
+		local[s.key(rel)] = true
+	}
+
+	input := &stds3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+	if s.targetPrefix != "" {
+		input.Prefix = aws.String(s.targetPrefix + "/")
+	}
+
+	var toDelete []string
+
+	for {
+		resp, err := s.svc.ListObjectsV2(input)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, obj := range resp.Contents {
+			key := aws.StringValue(obj.Key)
+			if !local[key] {
+				toDelete = append(toDelete, key)
+			}
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+
+	for _, key := range toDelete {
+		if s.dryRun {
+			s.logger.Info("delete-object", lager.Data{"event": "would-delete", "key": key})
+			continue
+		}
+
+		s.logger.Info("delete-object", lager.Data{"event": "deleting", "key": key})
+
+		if _, err := s.svc.DeleteObject(&stds3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(toDelete), nil
+}
+
+// fileHashes returns the hex-encoded sha256 and md5 digests of the file at
+// path in one pass.
+func fileHashes(path string) (sha256Hex, md5Hex string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	sh := sha256.New()
+	mh := md5.New()
+
+	if _, err := io.Copy(io.MultiWriter(sh, mh), f); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(sh.Sum(nil)), hex.EncodeToString(mh.Sum(nil)), nil
+}
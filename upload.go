@@ -1,54 +1,166 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/awsutil"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
 	stds3 "github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pivotal-cf/cf-redis-broker/s3"
 	"github.com/pivotal-golang/lager"
+	"github.com/st3v/s3upload/internal/uploader"
 )
 
+// vaultRefreshInterval controls how often a vault:// credential source is
+// proactively re-fetched in the background, ahead of its TTL expiring.
+const vaultRefreshInterval = 5 * time.Minute
+
+// main dispatches to the "sync" subcommand when given, or the default
+// single-file upload otherwise.
 func main() {
-	method := flag.String("method", "cli", "Upload method. [cli|sdk]")
-	sourcePath := flag.String("source", "", "Source path.")
-	targetPath := flag.String("target", "", "Target path.")
-	bucketName := flag.String("bucket", "", "Bucket name.")
-	endpoint := flag.String("endpoint", "", "S3 endpoint URL.")
-	region := flag.String("region", "", "S3 region.")
+	args := os.Args[1:]
+
+	if len(args) > 0 && args[0] == "sync" {
+		syncMain(args[1:])
+		return
+	}
+
+	uploadMain(args)
+}
+
+// commonFlags are the endpoint, backend-targeting, and credential flags
+// shared by every subcommand.
+type commonFlags struct {
+	endpoint     *string
+	region       *string
+	s3Compatible *bool
+	insecure     *bool
+	profile      *string
+	roleARN      *string
+	externalID   *string
+	mfaSerial    *string
+	vaultAddr    *string
+	vaultPath    *string
+}
 
-	flag.Parse()
+func bindCommonFlags(fs *flag.FlagSet) *commonFlags {
+	return &commonFlags{
+		endpoint:     fs.String("endpoint", "", "S3 endpoint URL."),
+		region:       fs.String("region", "", "S3 region."),
+		s3Compatible: fs.Bool("s3-compatible", false, "Target a non-AWS S3-compatible store (Ceph RGW, MinIO, ...). Implied when -endpoint is not an amazonaws.com host."),
+		insecure:     fs.Bool("insecure", false, "Disable TLS certificate verification against -endpoint. Only takes effect with -s3-compatible."),
+		profile:      fs.String("profile", os.Getenv("AWS_PROFILE"), "Shared credentials file profile to use."),
+		roleARN:      fs.String("role-arn", "", "ARN of an IAM role to assume via STS before uploading."),
+		externalID:   fs.String("external-id", "", "External ID to present when assuming -role-arn."),
+		mfaSerial:    fs.String("mfa-serial", "", "Serial number/ARN of the MFA device required to assume -role-arn. Prompts for a token code on stdin."),
+		vaultAddr:    fs.String("vault-addr", "", "HashiCorp Vault address to source credentials from, e.g. https://vault.example.com."),
+		vaultPath:    fs.String("vault-path", "", "Vault KV v2 path holding access_key/secret_key/session_token, e.g. secret/data/s3upload."),
+	}
+}
+
+func (c *commonFlags) credentialChainOptions() credentialChainOptions {
+	return credentialChainOptions{
+		profile:    *c.profile,
+		roleARN:    *c.roleARN,
+		externalID: *c.externalID,
+		mfaSerial:  *c.mfaSerial,
+		vaultAddr:  *c.vaultAddr,
+		vaultPath:  *c.vaultPath,
+	}
+}
+
+// isS3Compatible reports whether the sdk path should target endpoint as a
+// non-AWS S3-compatible store.
+func (c *commonFlags) isS3Compatible() bool {
+	return *c.s3Compatible || !isAWSEndpoint(*c.endpoint)
+}
+
+func uploadMain(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	common := bindCommonFlags(fs)
+
+	method := fs.String("method", "cli", "Upload method. [cli|sdk]")
+	sourcePath := fs.String("source", "", "Source path.")
+	targetPath := fs.String("target", "", "Target path.")
+	bucketName := fs.String("bucket", "", "Bucket name.")
+	partSize := fs.Int64("part-size", uploader.DefaultPartSize, "Multipart upload part size, in bytes.")
+	concurrency := fs.Int("concurrency", uploader.DefaultConcurrency, "Number of parts to upload concurrently.")
+	checkpoint := fs.String("checkpoint", "", "Path to a checkpoint file used to track multipart upload progress.")
+	resume := fs.Bool("resume", false, "Resume a previously interrupted upload using the checkpoint file.")
+	acl := fs.String("acl", "private", "Canned ACL applied to the uploaded object.")
+	sse := fs.String("sse", "", "Server-side encryption mode. [AES256|aws:kms]")
+	sseKMSKeyID := fs.String("sse-kms-key-id", "", "KMS key ID/ARN to use when -sse=aws:kms.")
+	storageClass := fs.String("storage-class", "", "S3 storage class. [STANDARD|STANDARD_IA|GLACIER|DEEP_ARCHIVE]")
+	contentType := fs.String("content-type", "", "Content-Type of the uploaded object. Auto-detected from -target's extension when omitted.")
+	tagging := fs.String("tagging", "", "URL-encoded object tag set, e.g. 'project=foo&env=prod'.")
+	metadata := metadataFlag{}
+	fs.Var(metadata, "metadata", "Object metadata entry, in key=value form. Repeatable.")
+
+	fs.Parse(args)
 
 	if *sourcePath == "" ||
 		*targetPath == "" ||
 		*bucketName == "" ||
-		*endpoint == "" ||
-		*region == "" {
-		flag.Usage()
+		*common.endpoint == "" ||
+		*common.region == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *resume && *checkpoint == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *sse != "" && *sse != "AES256" && *sse != "aws:kms" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *storageClass != "" && !validStorageClasses[*storageClass] {
+		fs.Usage()
 		os.Exit(1)
 	}
 
 	logger := lager.NewLogger("s3-upload")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
 
-	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	if accessKey == "" {
-		logError("getenv", errors.New("Env var AWS_ACCESS_KEY_ID not set"), logger)
+	creds := buildCredentialChain(common.credentialChainOptions(), logger)
+
+	if _, err := creds.Get(); err != nil {
+		logError("credentials", fmt.Errorf("no credential provider in the chain could supply AWS credentials: %s", err), logger)
 	}
 
-	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	if secretKey == "" {
-		logError("getenv", errors.New("Env var AWS_SECRET_ACCESS_KEY not set"), logger)
+	opts := uploadOptions{
+		partSize:             *partSize,
+		concurrency:          *concurrency,
+		checkpoint:           *checkpoint,
+		resume:               *resume,
+		s3Compatible:         common.isS3Compatible(),
+		insecure:             *common.insecure,
+		acl:                  *acl,
+		serverSideEncryption: *sse,
+		sseKMSKeyID:          *sseKMSKeyID,
+		storageClass:         *storageClass,
+		contentType:          *contentType,
+		metadata:             metadata,
+		tagging:              *tagging,
 	}
 
-	var upload func(string, string, string, string, string, string, string, lager.Logger)
+	var upload func(string, string, string, string, string, *credentials.Credentials, uploadOptions, lager.Logger)
 
 	switch *method {
 	case "cli":
@@ -63,111 +175,353 @@ func main() {
 		*sourcePath,
 		*targetPath,
 		*bucketName,
-		*endpoint,
-		*region,
-		accessKey,
-		secretKey,
+		*common.endpoint,
+		*common.region,
+		creds,
+		opts,
 		logger,
 	)
 }
 
-func sdkUpload(sourcePath, targetPath, bucketName, endpoint, region, accessKey, secretKey string, logger lager.Logger) {
-	logger.Info("sdk-upload", lager.Data{"event": "starting"})
+// credentialChainOptions configures buildCredentialChain.
+type credentialChainOptions struct {
+	profile    string
+	roleARN    string
+	externalID string
+	mfaSerial  string
+	vaultAddr  string
+	vaultPath  string
+}
 
-	config := aws.DefaultConfig
-	config.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
-	config.Endpoint = endpoint
-	config.Region = region
+// buildCredentialChain assembles the ordered list of credential providers
+// the tool falls back through: environment variables, the shared
+// credentials file, then remote instance credentials — ECS/Fargate's
+// container-credentials endpoint when AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+// is set, EC2 instance role metadata otherwise. If -vault-addr is set, a
+// HashiCorp Vault KV source is appended last, consulted only once all of the
+// above have nothing to offer. If -role-arn is set, the resulting chain is
+// wrapped in an STS AssumeRoleProvider so the tool uploads using a role's
+// temporary credentials rather than the caller's own.
+func buildCredentialChain(opts credentialChainOptions, logger lager.Logger) *credentials.Credentials {
+	providers := []credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{Profile: opts.profile},
+	}
 
-	s3 := stds3.New(config)
+	if sess, err := session.NewSession(); err == nil {
+		providers = append(providers, defaults.RemoteCredProvider(*sess.Config, sess.Handlers))
+	} else {
+		logger.Info("credential-chain", lager.Data{"event": "remote-cred-provider-disabled", "error": err.Error()})
+	}
 
-	logger.Info("find-bucket", lager.Data{"event": "starting"})
+	if opts.vaultAddr != "" {
+		vp := newVaultProvider(opts.vaultAddr, opts.vaultPath, os.Getenv("VAULT_TOKEN"))
+		vp.refreshPeriodically(vaultRefreshInterval, logger)
+		providers = append(providers, vp)
+	}
+
+	chain := credentials.NewChainCredentials(providers)
+
+	if opts.roleARN == "" {
+		return chain
+	}
 
-	found, err := bucketExists(s3, bucketName)
+	sess, err := session.NewSession(&aws.Config{Credentials: chain})
 	if err != nil {
-		logError("find-bucket", err, logger)
+		return chain
 	}
 
-	if found {
-		logger.Info("find-bucket", lager.Data{"event": "found"})
-	} else {
-		logger.Info("find-bucket", lager.Data{"event": "not-found"})
+	return stscreds.NewCredentials(sess, opts.roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if opts.externalID != "" {
+			p.ExternalID = aws.String(opts.externalID)
+		}
+		if opts.mfaSerial != "" {
+			p.SerialNumber = aws.String(opts.mfaSerial)
+			p.TokenProvider = stscreds.StdinTokenProvider
+		}
+	})
+}
+
+// vaultProvider implements credentials.Provider by reading AWS credentials
+// from a HashiCorp Vault KV v2 secret, refreshing them on expiry or via the
+// background loop started by refreshPeriodically.
+type vaultProvider struct {
+	addr  string
+	path  string
+	token string
+
+	httpClient *http.Client
+
+	mu         sync.Mutex
+	value      credentials.Value
+	expiration time.Time
+}
+
+func newVaultProvider(addr, path, token string) *vaultProvider {
+	return &vaultProvider{
+		addr:       strings.TrimRight(addr, "/"),
+		path:       strings.TrimLeft(path, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
 	}
+}
+
+func (v *vaultProvider) Retrieve() (credentials.Value, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.fetch(); err != nil {
+		return credentials.Value{}, err
+	}
+
+	return v.value, nil
+}
+
+func (v *vaultProvider) IsExpired() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return time.Now().After(v.expiration)
+}
+
+// refreshPeriodically re-fetches the secret from Vault on a fixed interval
+// so a long-running upload doesn't stall mid-transfer waiting on a
+// synchronous Retrieve() once the cached value expires.
+func (v *vaultProvider) refreshPeriodically(interval time.Duration, logger lager.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			v.mu.Lock()
+			err := v.fetch()
+			v.mu.Unlock()
+
+			if err != nil {
+				logger.Error("vault-refresh", err)
+			}
+		}
+	}()
+}
 
-	logger.Info("find-bucket", lager.Data{"event": "done"})
+type vaultSecretResponse struct {
+	LeaseDuration int `json:"lease_duration"`
+	Data          struct {
+		Data struct {
+			AccessKey    string `json:"access_key"`
+			SecretKey    string `json:"secret_key"`
+			SessionToken string `json:"session_token"`
+		} `json:"data"`
+	} `json:"data"`
+}
 
-	file, err := os.Open(sourcePath)
+func (v *vaultProvider) fetch() error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/%s", v.addr, v.path), nil)
 	if err != nil {
-		logError("open-file", err, logger)
+		return err
 	}
+	req.Header.Set("X-Vault-Token", v.token)
 
-	input := &s3manager.UploadInput{
-		ACL:    aws.String("private"),
-		Bucket: aws.String(bucketName),
-		Body:   file,
-		Key:    aws.String(targetPath),
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	u := s3manager.NewUploader(s3manager.DefaultUploadOptions)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault: unexpected status %s reading %s", resp.Status, v.path)
+	}
 
-	logger.Info("upload", lager.Data{"event": "starting"})
+	var secret vaultSecretResponse
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return err
+	}
 
-	if _, err = u.Upload(input); err != nil {
-		logError("upload", err, logger)
+	v.value = credentials.Value{
+		AccessKeyID:     secret.Data.Data.AccessKey,
+		SecretAccessKey: secret.Data.Data.SecretKey,
+		SessionToken:    secret.Data.Data.SessionToken,
+		ProviderName:    "VaultProvider",
 	}
 
-	logger.Info("upload", lager.Data{"event": "done"})
+	ttl := time.Duration(secret.LeaseDuration) * time.Second
+	if ttl <= 0 {
+		ttl = vaultRefreshInterval
+	}
+	v.expiration = time.Now().Add(ttl)
 
-	logger.Info("sdk-upload", lager.Data{"event": "done"})
+	return nil
+}
+
+// uploadOptions carries the multipart tuning, checkpointing, backend
+// targeting, and object attribute flags shared by the upload methods.
+type uploadOptions struct {
+	partSize     int64
+	concurrency  int
+	checkpoint   string
+	resume       bool
+	s3Compatible bool
+	insecure     bool
+
+	acl                  string
+	serverSideEncryption string
+	sseKMSKeyID          string
+	storageClass         string
+	contentType          string
+	metadata             metadataFlag
+	tagging              string
 }
 
-func bucketExists(svc *stds3.S3, bucketName string) (bool, error) {
-	params := &stds3.HeadBucketInput{
-		Bucket: aws.String(bucketName), // Required
+// validStorageClasses is the set of S3 storage classes the -storage-class
+// flag accepts.
+var validStorageClasses = map[string]bool{
+	"STANDARD":     true,
+	"STANDARD_IA":  true,
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+}
+
+// metadataFlag implements flag.Value to collect repeated -metadata
+// key=value entries into a map.
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
 	}
+	return strings.Join(pairs, ",")
+}
 
-	_, err := svc.HeadBucket(params)
-	if err != nil {
-		if reqErr, ok := err.(awserr.RequestFailure); ok {
-			if reqErr.StatusCode() == 404 {
-				return false, nil
-			}
-		}
-		return false, err
+func (m metadataFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid -metadata %q, expected key=value", value)
 	}
+	m[key] = val
+	return nil
+}
 
-	return true, nil
+// isAWSEndpoint reports whether endpoint looks like a real AWS S3 endpoint,
+// as opposed to a Ceph RGW/MinIO/other S3-compatible host. It's used to
+// auto-detect -s3-compatible when the flag isn't set explicitly.
+func isAWSEndpoint(endpoint string) bool {
+	return strings.Contains(endpoint, "amazonaws.com")
 }
 
-func createBucket(svc *stds3.S3, bucketName string) error {
-	params := &stds3.CreateBucketInput{
-		Bucket: aws.String(bucketName),
-		ACL:    aws.String("private"),
-		CreateBucketConfiguration: &stds3.CreateBucketConfiguration{
-			LocationConstraint: nil,
-		},
-		GrantFullControl: aws.String("GrantFullControl"),
-		GrantRead:        aws.String("GrantRead"),
-		GrantReadACP:     aws.String("GrantReadACP"),
-		GrantWrite:       aws.String("GrantWrite"),
-		GrantWriteACP:    aws.String("GrantWriteACP"),
+// newS3Client builds a session-backed *s3.S3 client for endpoint/region,
+// applying the path-style addressing, endpoint resolver, and TLS overrides
+// -s3-compatible/-insecure require to target a non-AWS store like Ceph RGW
+// or MinIO.
+func newS3Client(endpoint, region string, creds *credentials.Credentials, s3Compatible, insecure bool) (*stds3.S3, error) {
+	config := &aws.Config{
+		Credentials: creds,
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String(region),
+	}
+
+	if s3Compatible {
+		config.S3ForcePathStyle = aws.Bool(true)
+		config.EndpointResolver = endpoints.ResolverFunc(
+			func(service, _ string, _ ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+				return endpoints.ResolvedEndpoint{
+					URL:           endpoint,
+					SigningRegion: region,
+					SigningName:   service,
+				}, nil
+			},
+		)
+
+		if insecure {
+			config.HTTPClient = &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+		}
 	}
 
-	resp, err := svc.CreateBucket(params)
+	sess, err := session.NewSession(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Println(awsutil.StringValue(resp))
+	return stds3.New(sess), nil
+}
 
-	return nil
+// sdkUpload is a thin wiring layer: it builds the *s3.S3 client for
+// endpoint/region (applying S3-compatible overrides when requested) and
+// hands it to uploader.Uploader, which does the actual work.
+func sdkUpload(sourcePath, targetPath, bucketName, endpoint, region string, creds *credentials.Credentials, opts uploadOptions, logger lager.Logger) {
+	logger.Info("sdk-upload", lager.Data{"event": "starting"})
+
+	svc, err := newS3Client(endpoint, region, creds, opts.s3Compatible, opts.insecure)
+	if err != nil {
+		logError("sdk-upload", err, logger)
+	}
+
+	u := uploader.New(svc, logger)
+
+	if err := u.Upload(uploader.Params{
+		SourcePath:           sourcePath,
+		Bucket:               bucketName,
+		Key:                  targetPath,
+		PartSize:             opts.partSize,
+		Concurrency:          opts.concurrency,
+		Checkpoint:           opts.checkpoint,
+		Resume:               opts.resume,
+		ACL:                  opts.acl,
+		ServerSideEncryption: opts.serverSideEncryption,
+		SSEKMSKeyID:          opts.sseKMSKeyID,
+		StorageClass:         opts.storageClass,
+		ContentType:          opts.contentType,
+		Metadata:             opts.metadata,
+		Tagging:              opts.tagging,
+	}); err != nil {
+		logError("upload", err, logger)
+	}
+
+	logger.Info("sdk-upload", lager.Data{"event": "done"})
 }
 
-func cliUpload(sourcePath, targetPath, bucketName, endpoint, region, accessKey, secretKey string, logger lager.Logger) {
+// cliUpload uploads via the pivotal-cf/cf-redis-broker goamz-based client.
+// That client always addresses buckets virtual-hosted-style
+// (bucket.endpoint/key), with no path-style (endpoint/bucket/key) option
+// exposed, so it cannot correctly target Ceph RGW/MinIO the way -method=sdk
+// can: -s3-compatible is rejected below rather than silently producing
+// wrong requests. RGW/MinIO support is sdk-only by design, not an
+// oversight.
+func cliUpload(sourcePath, targetPath, bucketName, endpoint, region string, creds *credentials.Credentials, opts uploadOptions, logger lager.Logger) {
+	// Resuming depends on the checkpoint/ListParts machinery in
+	// internal/uploader, which the goamz-based client has no equivalent of;
+	// there's no cli resume path by design, not a gap left to fill in.
+	if opts.resume {
+		logError("upload", errors.New("resumable uploads are not supported by the cli method, use -method=sdk"), logger)
+	}
+
+	if opts.insecure {
+		logError("upload", errors.New("-insecure is not supported by the cli method, use -method=sdk"), logger)
+	}
+
+	if opts.s3Compatible {
+		logError("upload", errors.New("-s3-compatible (including targeting a non-amazonaws.com -endpoint) is not supported by the cli method, which always addresses buckets virtual-hosted-style; use -method=sdk"), logger)
+	}
+
+	if opts.serverSideEncryption != "" || opts.storageClass != "" || len(opts.metadata) > 0 || opts.tagging != "" || opts.contentType != "" || (opts.acl != "" && opts.acl != "private") {
+		logError("upload", errors.New("-sse, -storage-class, -metadata, -tagging, -content-type and non-default -acl are not supported by the cli method, use -method=sdk"), logger)
+	}
+
+	value, err := creds.Get()
+	if err != nil {
+		logError("credentials", err, logger)
+	}
+
+	if value.SessionToken != "" {
+		logError("credentials", errors.New("temporary/session credentials (role assumption, Vault leases) are not supported by the cli method, use -method=sdk"), logger)
+	}
+
 	client := s3.NewClient(
 		endpoint,
-		accessKey,
-		secretKey,
+		value.AccessKeyID,
+		value.SecretAccessKey,
 		logger,
 	)
 